@@ -0,0 +1,90 @@
+package gcsync
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	admin "google.golang.org/api/admin/directory/v1"
+	reports "google.golang.org/api/admin/reports/v1"
+	"google.golang.org/api/impersonate"
+)
+
+// CredentialSource selects how New obtains Google credentials.
+type CredentialSource string
+
+const (
+	// CredentialSourceServiceAccountJSON reads a downloaded service account
+	// key from Config.GCPCredentialsJSONFilePath and uses it directly,
+	// impersonating Config.DelegatedUserEmail via domain-wide delegation.
+	// This is the default, for compatibility with existing deployments.
+	CredentialSourceServiceAccountJSON CredentialSource = "service_account_json"
+	// CredentialSourceApplicationDefault uses Application Default
+	// Credentials (the GCE/GKE metadata server, or `gcloud auth
+	// application-default login`) as-is, with no impersonation. The ambient
+	// identity must already be authorized for the Admin SDK scopes directly.
+	CredentialSourceApplicationDefault CredentialSource = "application_default"
+	// CredentialSourceImpersonate uses Application Default Credentials to
+	// impersonate the service account named in Config.ImpersonateServiceAccount,
+	// which must have domain-wide delegation enabled, then delegates as
+	// Config.DelegatedUserEmail. This lets gcsync run on GKE/Cloud Run with
+	// no service account key file at all.
+	CredentialSourceImpersonate CredentialSource = "impersonate"
+)
+
+// googleScopes are the Admin SDK Directory and Reports scopes gcsync needs,
+// regardless of credential source.
+var googleScopes = []string{
+	admin.CloudPlatformScope,
+	admin.AdminDirectoryUserScope,
+	admin.AdminDirectoryUserReadonlyScope,
+	admin.AdminDirectoryGroupScope,
+	admin.AdminDirectoryGroupReadonlyScope,
+	reports.AdminReportsAuditReadonlyScope,
+}
+
+// googleHTTPClient builds the authenticated HTTP client the Directory and
+// Reports API clients are constructed with, per cfg.CredentialSource.
+func googleHTTPClient(ctx context.Context, cfg *Config) (*http.Client, error) {
+	switch cfg.CredentialSource {
+	case CredentialSourceApplicationDefault:
+		creds, err := google.FindDefaultCredentials(ctx, googleScopes...)
+		if err != nil {
+			return nil, fmt.Errorf("find application default credentials: %w", err)
+		}
+		return oauth2.NewClient(ctx, creds.TokenSource), nil
+
+	case CredentialSourceImpersonate:
+		if cfg.ImpersonateServiceAccount == "" {
+			return nil, fmt.Errorf("credential source %q requires ImpersonateServiceAccount", cfg.CredentialSource)
+		}
+		ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+			TargetPrincipal: cfg.ImpersonateServiceAccount,
+			Scopes:          googleScopes,
+			Subject:         cfg.DelegatedUserEmail,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("impersonate %q: %w", cfg.ImpersonateServiceAccount, err)
+		}
+		return oauth2.NewClient(ctx, ts), nil
+
+	case CredentialSourceServiceAccountJSON, "":
+		credJSON, err := os.ReadFile(cfg.GCPCredentialsJSONFilePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read credentials from %q: %v", cfg.GCPCredentialsJSONFilePath, err)
+		}
+
+		cjwt, err := google.JWTConfigFromJSON(credJSON, googleScopes...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create JWT config from JSON (bytes=%d): %v", len(credJSON), err)
+		}
+		cjwt.Subject = cfg.DelegatedUserEmail
+		return cjwt.Client(ctx), nil
+
+	default:
+		return nil, fmt.Errorf("unknown credential source %q", cfg.CredentialSource)
+	}
+}
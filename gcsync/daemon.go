@@ -0,0 +1,410 @@
+package gcsync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/google/uuid"
+	admin "google.golang.org/api/admin/directory/v1"
+	reports "google.golang.org/api/admin/reports/v1"
+
+	"github.com/coder/coder/v2/coderd/util/slice"
+	"github.com/coder/coder/v2/codersdk"
+)
+
+// WatchMode selects the backend Run uses to learn about Workspace changes
+// between full syncs.
+type WatchMode string
+
+const (
+	// WatchModeReportsPoll polls the Admin SDK Reports API for group/user
+	// change activities. It requires no extra infrastructure, at the cost
+	// of polling latency.
+	WatchModeReportsPoll WatchMode = "reports_poll"
+	// WatchModePubSub subscribes to a Cloud Pub/Sub topic fed by the
+	// Workspace Events API, for near-real-time resyncs.
+	WatchModePubSub WatchMode = "pubsub"
+)
+
+// pollDefaultInterval is used when Config.PollInterval is unset.
+const pollDefaultInterval = time.Minute
+
+// watchedGroupEvents are the Admin SDK Reports activity event names that
+// trigger an incremental group-membership resync (SyncUser) for the
+// affected member. CREATE_GROUP and DELETE_GROUP are deliberately not
+// watched here: their only email parameter is GROUP_EMAIL, which SyncUser
+// can't act on (it resyncs a single Coder user's membership, not a group's
+// member list), and a newly created group has no members yet regardless —
+// the ADD_GROUP_MEMBER events that follow are what actually need a resync.
+var watchedGroupEvents = map[string]bool{
+	"ADD_GROUP_MEMBER":    true,
+	"REMOVE_GROUP_MEMBER": true,
+}
+
+// watchedSuspendEvents are Reports activity event names that should suspend
+// the affected user's Coder account directly, rather than going through
+// SyncUser's group-membership resync.
+var watchedSuspendEvents = map[string]bool{
+	"SUSPEND_USER": true,
+}
+
+// Run starts gcsync as a long-running daemon: it performs one full
+// SyncGroups on startup, then watches for Workspace changes and triggers
+// targeted SyncUser resyncs as they arrive, rather than re-sweeping every
+// user on a timer. It blocks until ctx is canceled or a watch backend
+// returns a fatal error.
+func (s *Sync) Run(ctx context.Context) error {
+	log.Printf("running initial full sync")
+	stats, err := s.SyncGroups(ctx)
+	if err != nil {
+		return fmt.Errorf("initial sync: %w", err)
+	}
+	log.Printf("initial sync complete: %s", stats)
+
+	switch s.WatchMode {
+	case WatchModePubSub:
+		return s.watchPubSub(ctx)
+	case WatchModeReportsPoll, "":
+		return s.watchReportsPoll(ctx)
+	default:
+		return fmt.Errorf("unknown watch mode %q", s.WatchMode)
+	}
+}
+
+// SyncUser recomputes and applies group membership for a single user,
+// without sweeping the whole Coder user list. Run's incremental resync path
+// calls this for each user affected by a Workspace change event.
+func (s *Sync) SyncUser(ctx context.Context, email string) error {
+	defaultOrg, err := s.defaultOrganization(ctx)
+	if err != nil {
+		return err
+	}
+
+	user, ok, err := s.coderUserByEmail(ctx, email)
+	if err != nil {
+		return fmt.Errorf("failed to find coder user %s: %w", email, err)
+	}
+	if !ok {
+		log.Printf("SyncUser: %s has no Coder account, skipping", email)
+		return nil
+	}
+	if user.LoginType != codersdk.LoginTypeOIDC || !strings.HasSuffix(user.Email, "@"+s.EmailDomain) {
+		return nil
+	}
+
+	var nestedCandidates []*admin.Group
+	if s.NestedGroups {
+		nestedCandidates, _, err = s.AllGoogleGroups(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list all google groups: %w", err)
+		}
+	}
+
+	gGroups, _, err := s.resolveUserGoogleGroups(ctx, user.Email, nestedCandidates, NewNestedGroupCache())
+	if err != nil {
+		return err
+	}
+
+	if err := s.syncUserRoles(ctx, user, gGroups); err != nil {
+		log.Printf("failed to sync coder roles for %s: %v", user.Email, err)
+	}
+
+	coderGroups, err := s.coderGroups(ctx, defaultOrg.ID)
+	if err != nil {
+		return err
+	}
+
+	cGroups, err := s.CoderClient.Groups(ctx, codersdk.GroupArguments{
+		HasMember: user.Username,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get coder groups for %s: %w", email, err)
+	}
+
+	everyoneGroup := "Everyone"
+	var cGroupNames []string
+	for _, group := range cGroups {
+		cGroupNames = append(cGroupNames, group.Name)
+		if group.ID == defaultOrg.ID {
+			everyoneGroup = group.Name
+		}
+	}
+
+	expected := s.MappingConfig.ExpectedCoderGroups(gGroups)
+	add, remove := slice.SymmetricDifference(cGroupNames, append(expected, everyoneGroup))
+	changes := make(ChangeGroupRequests)
+	for _, group := range add {
+		changes.AddUser(group, user.ID.String())
+	}
+	for _, group := range remove {
+		changes.RemoveUser(group, user.ID.String())
+	}
+
+	if len(changes) == 0 {
+		return nil
+	}
+
+	coderGroups, changes, err = s.createMissingGroups(ctx, defaultOrg.ID, coderGroups, changes)
+	if err != nil {
+		return fmt.Errorf("failed to create missing groups: %w", err)
+	}
+
+	return s.applyGroupChanges(ctx, defaultOrg.ID, map[uuid.UUID]codersdk.User{user.ID: user}, coderGroups, changes)
+}
+
+// SuspendUser suspends a single Coder user by email in response to a
+// SUSPEND_USER Reports activity. It does not touch group membership; a
+// later SyncUser for the same user, or the full SyncGroups that Run performs
+// on startup, reconciles that separately.
+func (s *Sync) SuspendUser(ctx context.Context, email string) error {
+	user, ok, err := s.coderUserByEmail(ctx, email)
+	if err != nil {
+		return fmt.Errorf("failed to find coder user %s: %w", email, err)
+	}
+	if !ok {
+		log.Printf("SuspendUser: %s has no Coder account, skipping", email)
+		return nil
+	}
+	return s.suspendCoderUser(ctx, user)
+}
+
+func (s *Sync) coderUserByEmail(ctx context.Context, email string) (codersdk.User, bool, error) {
+	resp, err := s.CoderClient.Users(ctx, codersdk.UsersRequest{Search: email})
+	if err != nil {
+		return codersdk.User{}, false, err
+	}
+
+	for _, user := range resp.Users {
+		if strings.EqualFold(user.Email, email) {
+			return user, true, nil
+		}
+	}
+	return codersdk.User{}, false, nil
+}
+
+// checkpoint is the on-disk record of how far Run has gotten, so a restart
+// doesn't reprocess events it already synced.
+type checkpoint struct {
+	// LastActivityTime is the RFC3339 timestamp of the last processed
+	// Reports API activity, used by watchReportsPoll.
+	LastActivityTime string `json:"last_activity_time"`
+	// LastAckID is the last acked Pub/Sub message ID, used by watchPubSub
+	// purely for observability; Pub/Sub acks handle actual delivery.
+	LastAckID string `json:"last_ack_id"`
+}
+
+func (s *Sync) loadCheckpoint() checkpoint {
+	if s.CheckpointPath == "" {
+		return checkpoint{}
+	}
+
+	data, err := os.ReadFile(s.CheckpointPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("failed to read checkpoint %q, starting fresh: %v", s.CheckpointPath, err)
+		}
+		return checkpoint{}
+	}
+
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		log.Printf("failed to parse checkpoint %q, starting fresh: %v", s.CheckpointPath, err)
+		return checkpoint{}
+	}
+	return cp
+}
+
+func (s *Sync) saveCheckpoint(cp checkpoint) {
+	if s.CheckpointPath == "" {
+		return
+	}
+
+	data, err := json.Marshal(cp)
+	if err != nil {
+		log.Printf("failed to marshal checkpoint: %v", err)
+		return
+	}
+
+	if err := os.WriteFile(s.CheckpointPath, data, 0o600); err != nil {
+		log.Printf("failed to write checkpoint %q: %v", s.CheckpointPath, err)
+	}
+}
+
+// watchReportsPoll polls the Admin SDK Reports API on an interval for group
+// and user change activities, and triggers a SyncUser for each affected
+// email.
+func (s *Sync) watchReportsPoll(ctx context.Context) error {
+	interval := s.PollInterval
+	if interval <= 0 {
+		interval = pollDefaultInterval
+	}
+
+	cp := s.loadCheckpoint()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			actions, next, err := s.pollActivities(ctx, cp)
+			if err != nil {
+				log.Printf("failed to poll reports activities: %v", err)
+				continue
+			}
+
+			for email, kind := range actions {
+				switch kind {
+				case activityActionSuspend:
+					if err := s.SuspendUser(ctx, email); err != nil {
+						log.Printf("failed to suspend user %s: %v", email, err)
+					}
+				case activityActionSync:
+					if err := s.SyncUser(ctx, email); err != nil {
+						log.Printf("failed to sync user %s: %v", email, err)
+					}
+				}
+			}
+
+			cp = next
+			s.saveCheckpoint(cp)
+		}
+	}
+}
+
+// activityAction is what pollActivities decided to do about an affected
+// user, based on which watched event(s) named them.
+type activityAction int
+
+const (
+	// activityActionSync recomputes group membership via SyncUser.
+	activityActionSync activityAction = iota
+	// activityActionSuspend suspends the Coder account directly via
+	// SuspendUser. Takes priority over activityActionSync if both kinds of
+	// event name the same user within one poll.
+	activityActionSuspend
+)
+
+// pollActivities lists Reports API activities since cp and returns the
+// distinct user emails affected by a watched event, along with the action
+// to take for each and the checkpoint to resume from next time.
+func (s *Sync) pollActivities(ctx context.Context, cp checkpoint) (map[string]activityAction, checkpoint, error) {
+	call := s.ReportsClient.Activities.List("all", "admin").Context(ctx)
+	if cp.LastActivityTime != "" {
+		call = call.StartTime(cp.LastActivityTime)
+	}
+
+	affected := make(map[string]activityAction)
+	next := cp
+	pageToken := ""
+	for {
+		resp, err := call.PageToken(pageToken).Do()
+		if err != nil {
+			return nil, cp, fmt.Errorf("list activities: %w", err)
+		}
+
+		for _, activity := range resp.Items {
+			if activity.Id != nil && activity.Id.Time > next.LastActivityTime {
+				next.LastActivityTime = activity.Id.Time
+			}
+
+			for _, event := range activity.Events {
+				var kind activityAction
+				switch {
+				case watchedSuspendEvents[event.Name]:
+					kind = activityActionSuspend
+				case watchedGroupEvents[event.Name]:
+					kind = activityActionSync
+				default:
+					continue
+				}
+
+				email := activityEventEmail(event)
+				if email == "" {
+					continue
+				}
+				if _, ok := affected[email]; !ok || kind == activityActionSuspend {
+					affected[email] = kind
+				}
+			}
+		}
+
+		if resp.NextPageToken == "" {
+			break
+		}
+		pageToken = resp.NextPageToken
+	}
+
+	return affected, next, nil
+}
+
+// activityEventEmail extracts the member/target user email a watched
+// event's change applies to. Every event name in watchedGroupEvents and
+// watchedSuspendEvents carries a USER_EMAIL parameter, so this never needs
+// to fall back to the group's own address.
+func activityEventEmail(event *reports.ActivityEvents) string {
+	for _, param := range event.Parameters {
+		if param.Name == "USER_EMAIL" && param.Value != "" {
+			return param.Value
+		}
+	}
+	return ""
+}
+
+// watchPubSub subscribes to a Cloud Pub/Sub subscription fed by the
+// Workspace Events API and triggers a SyncUser for each message's affected
+// user. Messages are acked only after SyncUser succeeds, so a crash
+// redelivers rather than silently drops an event.
+func (s *Sync) watchPubSub(ctx context.Context) error {
+	client, err := pubsub.NewClient(ctx, s.PubSubProjectID)
+	if err != nil {
+		return fmt.Errorf("create pubsub client: %w", err)
+	}
+	defer client.Close()
+
+	sub := client.Subscription(s.PubSubSubscriptionID)
+	return sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		email, err := workspaceEventEmail(msg.Data)
+		if err != nil {
+			log.Printf("failed to parse workspace event: %v", err)
+			msg.Nack()
+			return
+		}
+		if email == "" {
+			msg.Ack()
+			return
+		}
+
+		if err := s.SyncUser(ctx, email); err != nil {
+			log.Printf("failed to sync user %s: %v", email, err)
+			msg.Nack()
+			return
+		}
+
+		msg.Ack()
+		s.saveCheckpoint(checkpoint{LastAckID: msg.ID})
+	})
+}
+
+// workspaceEvent is the minimal shape gcsync reads out of a Workspace Events
+// API Pub/Sub message; the full payload has many more fields we don't need.
+type workspaceEvent struct {
+	Subject struct {
+		Email string `json:"email"`
+	} `json:"subject"`
+}
+
+func workspaceEventEmail(data []byte) (string, error) {
+	var event workspaceEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return "", fmt.Errorf("unmarshal workspace event: %w", err)
+	}
+	return event.Subject.Email, nil
+}
@@ -2,24 +2,39 @@ package gcsync
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"sync"
 
 	admin "google.golang.org/api/admin/directory/v1"
+	"google.golang.org/api/googleapi"
 )
 
-func GoogleGroups(ctx context.Context, srv *admin.Service, email string) ([]*admin.Group, error) {
+// GoogleGroups lists the Google Groups email belongs to directly (not
+// nested). Every page fetch, not just the first, goes through s's rate
+// limiter and retry-with-backoff, since a large group list can span many
+// pages.
+func (s *Sync) GoogleGroups(ctx context.Context, email string) ([]*admin.Group, apiUsage, error) {
 	var allGroups []*admin.Group
+	var usage apiUsage
 	var pageToken string
 
 	// Call api until all groups are read. Loop for pagination
 	for {
-		googleGroups, err := srv.Groups.List().
-			Context(ctx).
-			PageToken(pageToken).
-			UserKey(email).
-			Do()
+		var googleGroups *admin.Groups
+		pageUsage, err := s.withGoogleRetry(ctx, func() error {
+			var err error
+			googleGroups, err = s.GoogleClient.Groups.List().
+				Context(ctx).
+				PageToken(pageToken).
+				UserKey(email).
+				Do()
+			return err
+		})
+		usage.add(pageUsage)
 		if err != nil {
-			return nil, fmt.Errorf("failed to list groups: %w", err)
+			return nil, usage, fmt.Errorf("failed to list groups: %w", err)
 		}
 
 		allGroups = append(allGroups, googleGroups.Groups...)
@@ -29,23 +44,163 @@ func GoogleGroups(ctx context.Context, srv *admin.Service, email string) ([]*adm
 		pageToken = googleGroups.NextPageToken
 	}
 
-	return allGroups, nil
+	return allGroups, usage, nil
 }
 
-func GoogleUsers(ctx context.Context, customerID string, srv *admin.Service) ([]*admin.User, error) {
+// AllGoogleGroups lists every group in the Workspace customer account. It is
+// the candidate set used when resolving nested (transitive) group
+// membership, since the Admin SDK has no "groups a group belongs to" query -
+// the only way to find nested membership is to check every group. Every
+// page fetch goes through s's rate limiter and retry-with-backoff.
+func (s *Sync) AllGoogleGroups(ctx context.Context) ([]*admin.Group, apiUsage, error) {
+	var allGroups []*admin.Group
+	var usage apiUsage
+	var pageToken string
+
+	// Call api until all groups are read. Loop for pagination
+	for {
+		var googleGroups *admin.Groups
+		pageUsage, err := s.withGoogleRetry(ctx, func() error {
+			var err error
+			googleGroups, err = s.GoogleClient.Groups.List().
+				Customer(s.GoogleCustomerID).
+				Context(ctx).
+				PageToken(pageToken).
+				Do()
+			return err
+		})
+		usage.add(pageUsage)
+		if err != nil {
+			return nil, usage, fmt.Errorf("failed to list groups: %w", err)
+		}
+
+		allGroups = append(allGroups, googleGroups.Groups...)
+		if googleGroups.NextPageToken == "" {
+			break
+		}
+		pageToken = googleGroups.NextPageToken
+	}
+
+	return allGroups, usage, nil
+}
+
+// IsGroupMember reports whether email is a member of the group identified by
+// groupKey. It prefers the cheap Members.HasMember call, which also counts
+// membership nested through another group, but which the Admin SDK rejects
+// with an HTTP 400 for members outside the group's primary domain, so it
+// falls back to Members.Get in that case to also support external members.
+// Members.Get only finds direct members, so on that fallback path an
+// external member who belongs only through a nested group is reported as
+// not a member.
+func IsGroupMember(ctx context.Context, srv *admin.Service, groupKey, email string) (bool, error) {
+	hasMember, err := srv.Members.HasMember(groupKey, email).Context(ctx).Do()
+	if err == nil {
+		return hasMember.IsMember, nil
+	}
+
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) || gerr.Code != http.StatusBadRequest {
+		return false, fmt.Errorf("failed to check membership of %s in group %s: %w", email, groupKey, err)
+	}
+
+	// HasMember refuses to answer for members outside the group's primary
+	// domain. Fall back to looking the member up directly.
+	_, err = srv.Members.Get(groupKey, email).Context(ctx).Do()
+	if err != nil {
+		var notFound *googleapi.Error
+		if errors.As(err, &notFound) && notFound.Code == http.StatusNotFound {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to get member %s of group %s: %w", email, groupKey, err)
+	}
+
+	return true, nil
+}
+
+// NestedGroupCache caches a user's resolved nested group membership across a
+// sync run, so syncing many users against the same candidate groups doesn't
+// repeat identical Admin SDK calls. It is safe for concurrent use, since
+// SyncGroups resolves multiple users' memberships in parallel.
+type NestedGroupCache struct {
+	mu    sync.Mutex
+	cache map[string][]*admin.Group
+}
+
+// NewNestedGroupCache returns an empty, ready-to-use NestedGroupCache.
+func NewNestedGroupCache() *NestedGroupCache {
+	return &NestedGroupCache{cache: make(map[string][]*admin.Group)}
+}
+
+// NestedGoogleGroups returns the groups from candidates that email is a
+// member of, directly or transitively through another group. Results are
+// cached in cache per email. checkMembership performs each per-candidate
+// membership check; callers that need rate limiting or retries wrap
+// IsGroupMember themselves and pass that wrapper in.
+func NestedGoogleGroups(ctx context.Context, email string, candidates []*admin.Group, cache *NestedGroupCache, checkMembership func(ctx context.Context, groupKey, email string) (bool, error)) ([]*admin.Group, error) {
+	cache.mu.Lock()
+	cached, ok := cache.cache[email]
+	cache.mu.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	var member []*admin.Group
+	for _, group := range candidates {
+		ok, err := checkMembership(ctx, group.Email, email)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			member = append(member, group)
+		}
+	}
+
+	cache.mu.Lock()
+	cache.cache[email] = member
+	cache.mu.Unlock()
+	return member, nil
+}
+
+// MergeGroups deduplicates groups from multiple sources by group email,
+// keeping a single entry per group.
+func MergeGroups(groupSets ...[]*admin.Group) []*admin.Group {
+	seen := make(map[string]*admin.Group)
+	for _, groups := range groupSets {
+		for _, group := range groups {
+			seen[group.Email] = group
+		}
+	}
+
+	merged := make([]*admin.Group, 0, len(seen))
+	for _, group := range seen {
+		merged = append(merged, group)
+	}
+	return merged
+}
+
+// GoogleUsers lists every user in the Workspace customer account. Every page
+// fetch goes through s's rate limiter and retry-with-backoff.
+func (s *Sync) GoogleUsers(ctx context.Context) ([]*admin.User, apiUsage, error) {
 	var allUsers []*admin.User
+	var usage apiUsage
 	var pageToken string
 
 	// Call api until all users are read. Loop for pagination
 	for {
-		googleUsers, err := srv.Users.List().
-			// Customer ID: https://support.google.com/a/answer/10070793?hl=en
-			Customer(customerID).
-			Context(ctx).
-			PageToken(pageToken).
-			Do()
+		var googleUsers *admin.Users
+		pageUsage, err := s.withGoogleRetry(ctx, func() error {
+			var err error
+			googleUsers, err = s.GoogleClient.Users.List().
+				// Customer ID: https://support.google.com/a/answer/10070793?hl=en
+				Customer(s.GoogleCustomerID).
+				Context(ctx).
+				PageToken(pageToken).
+				Do()
+			return err
+		})
+		usage.add(pageUsage)
 		if err != nil {
-			return nil, fmt.Errorf("failed to list users: %w", err)
+			return nil, usage, fmt.Errorf("failed to list users: %w", err)
 		}
 
 		allUsers = append(allUsers, googleUsers.Users...)
@@ -55,5 +210,5 @@ func GoogleUsers(ctx context.Context, customerID string, srv *admin.Service) ([]
 		pageToken = googleUsers.NextPageToken
 	}
 
-	return allUsers, nil
+	return allUsers, usage, nil
 }
@@ -0,0 +1,296 @@
+package gcsync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	admin "google.golang.org/api/admin/directory/v1"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultPolicy controls what happens to a Google Group that doesn't match
+// any entry in MappingConfig.Groups.
+type DefaultPolicy string
+
+const (
+	// DefaultPassthrough normalizes the Google Group's own name into a
+	// Coder group name, matching the tool's original hard-coded behavior.
+	DefaultPassthrough DefaultPolicy = "passthrough"
+	// DefaultIgnore drops unmapped Google Groups; users in them gain no
+	// corresponding Coder group membership.
+	DefaultIgnore DefaultPolicy = "ignore"
+)
+
+// GroupMapping maps a single Google Group, matched either by its exact email
+// or by a regex pattern against its email, to a Coder group.
+type GroupMapping struct {
+	// Email matches a Google Group by its exact email address. Mutually
+	// exclusive with Pattern; Email takes precedence if both are set.
+	Email string `yaml:"google_group_email,omitempty" json:"google_group_email,omitempty"`
+	// Pattern matches a Google Group email against a regular expression.
+	// CoderGroup may reference its capture groups with "$1", "$2", etc.
+	Pattern string `yaml:"pattern,omitempty" json:"pattern,omitempty"`
+
+	// CoderGroup is the resulting Coder group name. When Pattern is set,
+	// this is expanded as a regexp replacement template against the
+	// matched email.
+	CoderGroup string `yaml:"coder_group_name" json:"coder_group_name"`
+
+	// QuotaAllowance, DisplayName, and AvatarURL are applied when
+	// createMissingGroups has to create CoderGroup for the first time.
+	QuotaAllowance int    `yaml:"quota_allowance,omitempty" json:"quota_allowance,omitempty"`
+	DisplayName    string `yaml:"display_name,omitempty" json:"display_name,omitempty"`
+	AvatarURL      string `yaml:"avatar_url,omitempty" json:"avatar_url,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// match returns the Coder group name this mapping produces for group, if it
+// applies.
+func (g GroupMapping) match(group *admin.Group) (string, bool) {
+	if g.Email != "" {
+		if g.Email != group.Email {
+			return "", false
+		}
+		return g.CoderGroup, true
+	}
+
+	if g.re == nil || !g.re.MatchString(group.Email) {
+		return "", false
+	}
+	return string(g.re.ReplaceAll([]byte(group.Email), []byte(g.CoderGroup))), true
+}
+
+// MappingConfig declaratively maps Google Groups (and, via Roles, Google
+// Group membership) onto Coder groups and site roles. It replaces the
+// original hard-coded name normalization in ExpectedCoderGroups.
+type MappingConfig struct {
+	// Groups are tried in order; the first entry that matches a Google
+	// Group wins.
+	Groups []GroupMapping `yaml:"groups" json:"groups"`
+	// Default controls unmapped Google Groups. Empty is treated as
+	// DefaultPassthrough, matching the tool's original behavior.
+	Default DefaultPolicy `yaml:"default" json:"default"`
+	// Roles maps a Google Group email to a Coder site role granted to its
+	// members, e.g. "gsuite-admins" -> "owner".
+	Roles map[string]string `yaml:"roles" json:"roles"`
+
+	// resolvedMu guards resolved, since SyncGroups resolves multiple users'
+	// (and therefore groups') mappings concurrently.
+	resolvedMu sync.Mutex
+	// resolved remembers which mapping produced each Coder group name, so
+	// createMissingGroups can look up its QuotaAllowance/DisplayName/
+	// AvatarURL without re-matching against the original Google Group.
+	resolved map[string]GroupMapping
+}
+
+// LoadMappingConfig reads and parses a mapping config file. The format is
+// chosen by file extension: ".json" is parsed as JSON, anything else as
+// YAML.
+func LoadMappingConfig(path string) (*MappingConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read mapping config %q: %w", path, err)
+	}
+
+	var cfg MappingConfig
+	if strings.HasSuffix(path, ".json") {
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("parse mapping config %q as json: %w", path, err)
+		}
+	} else {
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("parse mapping config %q as yaml: %w", path, err)
+		}
+	}
+
+	for i, mapping := range cfg.Groups {
+		if mapping.Pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile(mapping.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("mapping %d: invalid pattern %q: %w", i, mapping.Pattern, err)
+		}
+		cfg.Groups[i].re = re
+	}
+
+	return &cfg, nil
+}
+
+// ExpectedCoderGroups returns the Coder group names a user should be in
+// given the Google Groups they belong to. With a nil MappingConfig, this
+// falls back to the tool's original behavior of normalizing every Google
+// Group's own name.
+func (m *MappingConfig) ExpectedCoderGroups(groups []*admin.Group) []string {
+	var expected []string
+	for _, group := range groups {
+		name, ok := m.mapGroup(group)
+		if !ok {
+			continue
+		}
+		expected = append(expected, name)
+	}
+	return expected
+}
+
+func (m *MappingConfig) mapGroup(group *admin.Group) (string, bool) {
+	if m == nil {
+		return defaultGroupName(group)
+	}
+
+	for _, mapping := range m.Groups {
+		name, ok := mapping.match(group)
+		if !ok {
+			continue
+		}
+		m.resolvedMu.Lock()
+		if m.resolved == nil {
+			m.resolved = make(map[string]GroupMapping)
+		}
+		m.resolved[name] = mapping
+		m.resolvedMu.Unlock()
+		return name, true
+	}
+
+	if m.Default == DefaultIgnore {
+		return "", false
+	}
+	return defaultGroupName(group)
+}
+
+// defaultGroupName is the tool's original normalization: lowercase the
+// Google Group's name and strip spaces.
+func defaultGroupName(group *admin.Group) (string, bool) {
+	if group.Name == "" {
+		log.Printf("Google Group %s has no groupname, skipping", group.Email)
+		return "", false
+	}
+	return strings.ToLower(strings.ReplaceAll(group.Name, " ", "")), true
+}
+
+// GroupSettings returns the group-creation settings (quota allowance,
+// display name, avatar URL) configured for coderGroup via whichever mapping
+// last resolved it. It returns ok=false if m is nil or coderGroup was never
+// resolved through a mapping (e.g. it only exists via DefaultPassthrough).
+func (m *MappingConfig) GroupSettings(coderGroup string) (GroupMapping, bool) {
+	if m == nil {
+		return GroupMapping{}, false
+	}
+	m.resolvedMu.Lock()
+	defer m.resolvedMu.Unlock()
+	mapping, ok := m.resolved[coderGroup]
+	return mapping, ok
+}
+
+// rolesFor returns the set of Coder site roles a user should hold given the
+// Google Groups they belong to.
+func (m *MappingConfig) rolesFor(groups []*admin.Group) []string {
+	if m == nil || len(m.Roles) == 0 {
+		return nil
+	}
+
+	roleSet := make(map[string]struct{})
+	for _, group := range groups {
+		if role, ok := m.Roles[group.Email]; ok {
+			roleSet[role] = struct{}{}
+		}
+	}
+	if len(roleSet) == 0 {
+		return nil
+	}
+
+	roles := make([]string, 0, len(roleSet))
+	for role := range roleSet {
+		roles = append(roles, role)
+	}
+	return roles
+}
+
+// managedRoles returns the set of Coder site roles m.Roles can grant, i.e.
+// the roles syncUserRoles owns and will revoke from a user who no longer
+// qualifies for them. Roles on an account that aren't in this set were
+// granted outside gcsync and are left untouched.
+func (m *MappingConfig) managedRoles() map[string]struct{} {
+	managed := make(map[string]struct{}, len(m.Roles))
+	if m == nil {
+		return managed
+	}
+	for _, role := range m.Roles {
+		managed[role] = struct{}{}
+	}
+	return managed
+}
+
+// LintConfig validates a mapping config against live Google Workspace and
+// Coder state: every explicit google_group_email must exist in Workspace,
+// every regex pattern must compile, and every mapped role must be a valid
+// Coder site role. It returns one error per problem found; a nil/empty
+// result means the config is safe to use.
+func (s *Sync) LintConfig(ctx context.Context, mapping *MappingConfig) []error {
+	var problems []error
+
+	googleGroups, _, err := s.AllGoogleGroups(ctx)
+	if err != nil {
+		return []error{fmt.Errorf("failed to list google groups: %w", err)}
+	}
+	byEmail := make(map[string]*admin.Group, len(googleGroups))
+	for _, group := range googleGroups {
+		byEmail[group.Email] = group
+	}
+
+	for i, groupMapping := range mapping.Groups {
+		switch {
+		case groupMapping.Email != "":
+			if _, ok := byEmail[groupMapping.Email]; !ok {
+				problems = append(problems, fmt.Errorf("mapping %d: google group %q not found in Workspace", i, groupMapping.Email))
+			}
+		case groupMapping.Pattern != "":
+			if _, err := regexp.Compile(groupMapping.Pattern); err != nil {
+				problems = append(problems, fmt.Errorf("mapping %d: invalid pattern %q: %w", i, groupMapping.Pattern, err))
+				continue
+			}
+			anyMatch := false
+			for _, group := range googleGroups {
+				if groupMapping.re != nil && groupMapping.re.MatchString(group.Email) {
+					anyMatch = true
+					break
+				}
+			}
+			if !anyMatch {
+				log.Printf("mapping %d: pattern %q matches no current Google Group", i, groupMapping.Pattern)
+			}
+		default:
+			problems = append(problems, fmt.Errorf("mapping %d: neither google_group_email nor pattern is set", i))
+		}
+	}
+
+	if mapping.Default != "" && mapping.Default != DefaultPassthrough && mapping.Default != DefaultIgnore {
+		problems = append(problems, fmt.Errorf("default policy %q must be %q or %q", mapping.Default, DefaultPassthrough, DefaultIgnore))
+	}
+
+	if len(mapping.Roles) > 0 {
+		roles, err := s.CoderClient.ListSiteRoles(ctx)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("failed to list coder site roles: %w", err))
+		} else {
+			valid := make(map[string]bool, len(roles))
+			for _, role := range roles {
+				valid[role.Name] = true
+			}
+			for email, role := range mapping.Roles {
+				if !valid[role] {
+					problems = append(problems, fmt.Errorf("role mapping %q -> %q: %q is not a valid coder site role", email, role, role))
+				}
+			}
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,112 @@
+package gcsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/api/googleapi"
+)
+
+// defaultGoogleQPS matches the Admin SDK directory API's default per-user
+// quota closely enough to avoid tripping it in normal operation.
+const defaultGoogleQPS = 5
+
+// maxGoogleRetries bounds the exponential backoff retry loop in
+// withGoogleRetry.
+const maxGoogleRetries = 5
+
+// retryBaseDelay is the starting backoff delay; it doubles each retry and
+// gets up to retryBaseDelay of jitter added.
+const retryBaseDelay = 500 * time.Millisecond
+
+// newGoogleLimiter returns a token-bucket limiter tuned to qps, falling back
+// to defaultGoogleQPS when qps is unset.
+func newGoogleLimiter(qps float64) *rate.Limiter {
+	if qps <= 0 {
+		qps = defaultGoogleQPS
+	}
+	return rate.NewLimiter(rate.Limit(qps), 1)
+}
+
+// apiUsage tallies Admin SDK call volume for SyncStats.
+type apiUsage struct {
+	Calls   int
+	Retries int
+}
+
+func (u *apiUsage) add(other apiUsage) {
+	u.Calls += other.Calls
+	u.Retries += other.Retries
+}
+
+// withGoogleRetry waits on s's rate limiter, then runs fn, retrying with
+// exponential backoff on 429/503 responses from the Admin SDK.
+func (s *Sync) withGoogleRetry(ctx context.Context, fn func() error) (apiUsage, error) {
+	var usage apiUsage
+	for attempt := 0; ; attempt++ {
+		if err := s.limiter.Wait(ctx); err != nil {
+			return usage, err
+		}
+
+		usage.Calls++
+		err := fn()
+		if err == nil {
+			return usage, nil
+		}
+
+		if !isRetryableGoogleError(err) || attempt >= maxGoogleRetries {
+			return usage, err
+		}
+
+		usage.Retries++
+		delay := retryBaseDelay*time.Duration(1<<attempt) + time.Duration(rand.Int63n(int64(retryBaseDelay)))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return usage, ctx.Err()
+		}
+	}
+}
+
+func isRetryableGoogleError(err error) bool {
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) {
+		return false
+	}
+	return gerr.Code == http.StatusTooManyRequests || gerr.Code == http.StatusServiceUnavailable
+}
+
+// UserSyncStats reports how long and how much Admin SDK traffic a single
+// user's sync took, for operators diagnosing whether a run is quota-bound.
+type UserSyncStats struct {
+	Email    string
+	Duration time.Duration
+	APICalls int
+	Retries  int
+}
+
+// SyncStats summarizes a SyncGroups run: per-user timings plus totals, so
+// operators can tell a slow sync from a quota-bound one.
+type SyncStats struct {
+	PerUser  []UserSyncStats
+	Duration time.Duration
+	APICalls int
+	Retries  int
+}
+
+func (s *SyncStats) addUser(stats UserSyncStats) {
+	s.PerUser = append(s.PerUser, stats)
+	s.APICalls += stats.APICalls
+	s.Retries += stats.Retries
+}
+
+// String renders a short operator-facing summary, e.g. for a log line after
+// SyncGroups returns.
+func (s SyncStats) String() string {
+	return fmt.Sprintf("%d users, %d api calls, %d retries, %s", len(s.PerUser), s.APICalls, s.Retries, s.Duration)
+}
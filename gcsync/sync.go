@@ -5,22 +5,63 @@ import (
 	"fmt"
 	"log"
 	"net/url"
-	"os"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
-	"golang.org/x/oauth2/google"
+	"golang.org/x/time/rate"
 	admin "google.golang.org/api/admin/directory/v1"
+	reports "google.golang.org/api/admin/reports/v1"
 	"google.golang.org/api/option"
 
 	"github.com/coder/coder/v2/coderd/util/slice"
 	"github.com/coder/coder/v2/codersdk"
 )
 
+// defaultSyncConcurrency is used when Config.Concurrency is unset.
+const defaultSyncConcurrency = 10
+
 type Sync struct {
-	CoderClient  *codersdk.Client
-	GoogleClient *admin.Service
-	EmailDomain  string
+	CoderClient      *codersdk.Client
+	GoogleClient     *admin.Service
+	ReportsClient    *reports.Service
+	EmailDomain      string
+	GoogleCustomerID string
+	// NestedGroups, when true, expands a user's expected Coder groups to
+	// include transitive (nested) Google Group membership, not just the
+	// groups returned directly for their user key.
+	NestedGroups bool
+	// DryRun, when true, logs the mutations SyncUsers would make without
+	// calling any Coder write API.
+	DryRun bool
+	// MappingConfig, if set, replaces the hard-coded group name
+	// normalization in ExpectedCoderGroups with declarative Google->Coder
+	// group/role mappings.
+	MappingConfig *MappingConfig
+
+	// WatchMode selects how Run watches for Workspace changes between full
+	// syncs. Defaults to WatchModeReportsPoll.
+	WatchMode WatchMode
+	// PollInterval is how often Run polls the Admin SDK Reports API in
+	// WatchModeReportsPoll. Defaults to pollDefaultInterval.
+	PollInterval time.Duration
+	// CheckpointPath is where Run persists the last-processed Reports
+	// activity (or Pub/Sub ack cursor) so restarts don't reprocess events.
+	CheckpointPath string
+	// PubSubProjectID and PubSubSubscriptionID configure the Workspace
+	// Events API subscriber used in WatchModePubSub.
+	PubSubProjectID      string
+	PubSubSubscriptionID string
+
+	// Concurrency bounds how many users SyncGroups resolves and patches in
+	// parallel. Defaults to defaultSyncConcurrency.
+	Concurrency int
+	// limiter paces the Admin SDK calls SyncGroups makes, built from
+	// Config.GoogleQPS. The Members.Get fallback inside IsGroupMember is
+	// not paced separately (see resolveUserGoogleGroups).
+	limiter *rate.Limiter
 }
 
 type Config struct {
@@ -32,15 +73,57 @@ type Config struct {
 	// GoogleCustomerID should be the Google Workspace customer ID.
 	// From https://support.google.com/a/answer/10070793?hl=en
 	GoogleCustomerID string
+	// CredentialSource selects how Google credentials are obtained. Defaults
+	// to CredentialSourceServiceAccountJSON.
+	CredentialSource CredentialSource
 	// GCPCredentialsJSONFilePath should be a service account json file
-	// with credentials.
+	// with credentials. Only used when CredentialSource is
+	// CredentialSourceServiceAccountJSON.
 	GCPCredentialsJSONFilePath string
+	// ImpersonateServiceAccount is the email of the service account to
+	// impersonate when CredentialSource is CredentialSourceImpersonate. The
+	// service account must have domain-wide delegation enabled.
+	ImpersonateServiceAccount string
 	// DelegatedUserEmail should be the email of the Google Workspace admin
 	// https://developers.google.com/identity/protocols/oauth2/service-account#delegatingauthority
 	DelegatedUserEmail string
 	// EmailDomain should be the domain of the Google Workspace.
 	// This is used to ignore users that are not in Google Workspace.
 	EmailDomain string
+	// NestedGroups opts into resolving transitive (nested) Google Group
+	// membership when computing a user's expected Coder groups. This costs
+	// an extra Members.HasMember/Members.Get call per candidate group per
+	// user, so it is off by default.
+	NestedGroups bool
+	// DryRun, when true, logs the mutations SyncUsers would make without
+	// calling any Coder write API.
+	DryRun bool
+	// MappingConfig, if set, replaces the hard-coded group name
+	// normalization in ExpectedCoderGroups with declarative Google->Coder
+	// group/role mappings. Load one with LoadMappingConfig.
+	MappingConfig *MappingConfig
+
+	// WatchMode selects how Run watches for Workspace changes between full
+	// syncs. Defaults to WatchModeReportsPoll.
+	WatchMode WatchMode
+	// PollInterval is how often Run polls the Admin SDK Reports API in
+	// WatchModeReportsPoll. Defaults to pollDefaultInterval.
+	PollInterval time.Duration
+	// CheckpointPath is where Run persists the last-processed Reports
+	// activity (or Pub/Sub ack cursor) so restarts don't reprocess events.
+	CheckpointPath string
+	// PubSubProjectID and PubSubSubscriptionID configure the Workspace
+	// Events API subscriber used in WatchModePubSub.
+	PubSubProjectID      string
+	PubSubSubscriptionID string
+
+	// Concurrency bounds how many users SyncGroups resolves and patches in
+	// parallel. Defaults to defaultSyncConcurrency.
+	Concurrency int
+	// GoogleQPS caps how many Admin SDK requests per second SyncGroups
+	// issues, tuned to Google's directory quota. Defaults to
+	// defaultGoogleQPS.
+	GoogleQPS float64
 }
 
 func New(ctx context.Context, cfg *Config) (*Sync, error) {
@@ -53,47 +136,65 @@ func New(ctx context.Context, cfg *Config) (*Sync, error) {
 		return nil, fmt.Errorf("failed to authenticate with coder: %w", err)
 	}
 
-	// Google Workspace Admin SDK Client
-	credJSON, err := os.ReadFile(cfg.GCPCredentialsJSONFilePath)
+	// Google Workspace Admin SDK Client, authenticated per cfg.CredentialSource.
+	httpClient, err := googleHTTPClient(ctx, cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read credentials from %q: %v", cfg.GCPCredentialsJSONFilePath, err)
+		return nil, fmt.Errorf("authenticate google: %w", err)
 	}
 
-	// Auth with Google using delegated credentials
-	cjwt, err := google.JWTConfigFromJSON(credJSON, admin.CloudPlatformScope,
-		admin.AdminDirectoryUserScope,
-		admin.AdminDirectoryUserReadonlyScope,
-		admin.AdminDirectoryGroupScope,
-		admin.AdminDirectoryGroupReadonlyScope)
+	adminService, err := admin.NewService(ctx,
+		option.WithHTTPClient(httpClient),
+	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create JWT config from JSON (bytes=%d): %v", len(credJSON), err)
+		return nil, fmt.Errorf("authenticate google: %w", err)
 	}
-	cjwt.Subject = cfg.DelegatedUserEmail
 
-	// Authenticate with Google
-	adminService, err := admin.NewService(ctx,
-		option.WithHTTPClient(cjwt.Client(ctx)),
+	// Reports API client, used by Run's WatchModeReportsPoll backend. It
+	// shares the same credentials as the Directory API client.
+	reportsService, err := reports.NewService(ctx,
+		option.WithHTTPClient(httpClient),
 	)
 	if err != nil {
-		return nil, fmt.Errorf("authenticate google: %w", err)
+		return nil, fmt.Errorf("authenticate google reports: %w", err)
 	}
 
 	return &Sync{
-		CoderClient:  client,
-		GoogleClient: adminService,
-		EmailDomain:  cfg.EmailDomain,
+		CoderClient:          client,
+		GoogleClient:         adminService,
+		ReportsClient:        reportsService,
+		EmailDomain:          cfg.EmailDomain,
+		GoogleCustomerID:     cfg.GoogleCustomerID,
+		NestedGroups:         cfg.NestedGroups,
+		DryRun:               cfg.DryRun,
+		MappingConfig:        cfg.MappingConfig,
+		WatchMode:            cfg.WatchMode,
+		PollInterval:         cfg.PollInterval,
+		CheckpointPath:       cfg.CheckpointPath,
+		PubSubProjectID:      cfg.PubSubProjectID,
+		PubSubSubscriptionID: cfg.PubSubSubscriptionID,
+		Concurrency:          cfg.Concurrency,
+		limiter:              newGoogleLimiter(cfg.GoogleQPS),
 	}, nil
 }
 
-func (s *Sync) SyncGroups(ctx context.Context) error {
+// SyncGroups reconciles Coder group membership against Google Groups for
+// every OIDC user in s.EmailDomain. Users are resolved concurrently, bounded
+// by s.Concurrency, since each one costs two independent API round-trips
+// (GoogleGroups/nested resolution, and CoderClient.Groups). The returned
+// SyncStats reports per-user timings and Admin SDK call/retry counts so
+// operators can tell a slow run from a quota-bound one.
+func (s *Sync) SyncGroups(ctx context.Context) (SyncStats, error) {
+	start := time.Now()
+	var stats SyncStats
+
 	defaultOrg, err := s.defaultOrganization(ctx)
 	if err != nil {
-		return err
+		return stats, err
 	}
 
 	coderGroups, err := s.coderGroups(ctx, defaultOrg.ID)
 	if err != nil {
-		return err
+		return stats, err
 	}
 
 	userByID := make(map[uuid.UUID]codersdk.User) // Used for logging/debugging
@@ -102,12 +203,36 @@ func (s *Sync) SyncGroups(ctx context.Context) error {
 	// Find all users on Coder
 	coderUsers, err := s.CoderClient.Users(ctx, codersdk.UsersRequest{})
 	if err != nil {
-		return fmt.Errorf("failed to get coder users: %w", err)
+		return stats, fmt.Errorf("failed to get coder users: %w", err)
+	}
+
+	// When resolving nested groups, every user is checked for membership
+	// against the same candidate set, so fetch it once and cache each
+	// user's resolved membership for the rest of the run.
+	var nestedCandidates []*admin.Group
+	nestedCache := NewNestedGroupCache()
+	if s.NestedGroups {
+		var candidatesUsage apiUsage
+		nestedCandidates, candidatesUsage, err = s.AllGoogleGroups(ctx)
+		stats.APICalls += candidatesUsage.Calls
+		stats.Retries += candidatesUsage.Retries
+		if err != nil {
+			return stats, fmt.Errorf("failed to list all google groups: %w", err)
+		}
+	}
+
+	concurrency := s.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultSyncConcurrency
 	}
 
-	oidcUserCount := 0
-	// For each user, find the groups they are in on Google Workspace
-	// and on Coder. Then calculate the changes needed to sync the groups.
+	var (
+		mu            sync.Mutex
+		wg            sync.WaitGroup
+		sem           = make(chan struct{}, concurrency)
+		oidcUserCount int
+	)
+
 	for _, user := range coderUsers.Users {
 		userByID[user.ID] = user
 		if user.LoginType != codersdk.LoginTypeOIDC {
@@ -118,60 +243,283 @@ func (s *Sync) SyncGroups(ctx context.Context) error {
 		if !strings.HasSuffix(user.Email, "@"+s.EmailDomain) {
 			continue
 		}
-		oidcUserCount++
 
-		gGroups, err := GoogleGroups(ctx, s.GoogleClient, user.Email)
-		if err != nil {
-			log.Fatalf("failed to get Google Groups for %s: %v", user.Email, err)
-		}
+		user := user
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
 
-		cGroups, err := s.CoderClient.Groups(ctx, codersdk.GroupArguments{
-			HasMember: user.Username,
-		})
-		if err != nil {
-			log.Fatalf("failed to get coder groups for user %s: %v", user.Email, err)
-		}
+			userStart := time.Now()
+			add, remove, usage, err := s.userGroupChanges(ctx, defaultOrg.ID, user, nestedCandidates, nestedCache)
 
-		// Everyone group should include everyone, so always include it.
-		var everyoneGroup = "Everyone"
-		var cGroupNames []string
-		for _, group := range cGroups {
-			cGroupNames = append(cGroupNames, group.Name)
-			if group.ID == defaultOrg.ID {
-				everyoneGroup = group.Name
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.Printf("failed to compute group changes for %s: %v", user.Email, err)
+				return
 			}
-		}
 
-		expected := ExpectedCoderGroups(gGroups)
-		// expected is the set of groups the user should be in
-		// SymmetricDifference returns the groups to add & remove
-		// to make the set {cGroupNames} match the set {expected}
-		add, remove := slice.SymmetricDifference(cGroupNames, append(expected, everyoneGroup))
-		for _, group := range add {
-			coderGroupChanges.AddUser(group, user.ID.String())
-		}
-		for _, group := range remove {
-			coderGroupChanges.RemoveUser(group, user.ID.String())
-		}
+			oidcUserCount++
+			for _, group := range add {
+				coderGroupChanges.AddUser(group, user.ID.String())
+			}
+			for _, group := range remove {
+				coderGroupChanges.RemoveUser(group, user.ID.String())
+			}
+			stats.addUser(UserSyncStats{
+				Email:    user.Email,
+				Duration: time.Since(userStart),
+				APICalls: usage.Calls,
+				Retries:  usage.Retries,
+			})
+		}()
 	}
+	wg.Wait()
+
+	stats.Duration = time.Since(start)
 
 	if len(coderGroupChanges) == 0 {
 		log.Printf("No changes to make, all %d OIDC users in your Google domain are in the correct groups", oidcUserCount)
-		return nil
+		return stats, nil
 	}
 
 	// Create missing groups and update our coderGroups map
 	coderGroups, coderGroupChanges, err = s.createMissingGroups(ctx, defaultOrg.ID, coderGroups, coderGroupChanges)
 	if err != nil {
-		return fmt.Errorf("failed to create missing groups: %w", err)
+		return stats, fmt.Errorf("failed to create missing groups: %w", err)
 	}
 
 	// Apply the changes to the groups
 	err = s.applyGroupChanges(ctx, defaultOrg.ID, userByID, coderGroups, coderGroupChanges)
 	if err != nil {
-		return fmt.Errorf("failed to apply group changes: %w", err)
+		return stats, fmt.Errorf("failed to apply group changes: %w", err)
+	}
+
+	return stats, nil
+}
+
+// userGroupChanges computes the Coder group adds/removes needed to match a
+// single user's Google Group membership, and syncs any mapped Coder roles
+// as a side effect. It is safe to call concurrently for different users.
+func (s *Sync) userGroupChanges(ctx context.Context, orgID uuid.UUID, user codersdk.User, nestedCandidates []*admin.Group, nestedCache *NestedGroupCache) (add, remove []string, usage apiUsage, err error) {
+	gGroups, usage, err := s.resolveUserGoogleGroups(ctx, user.Email, nestedCandidates, nestedCache)
+	if err != nil {
+		return nil, nil, usage, err
 	}
 
+	cGroups, err := s.CoderClient.Groups(ctx, codersdk.GroupArguments{
+		HasMember: user.Username,
+	})
+	if err != nil {
+		return nil, nil, usage, fmt.Errorf("failed to get coder groups for user %s: %w", user.Email, err)
+	}
+
+	// Everyone group should include everyone, so always include it.
+	var everyoneGroup = "Everyone"
+	var cGroupNames []string
+	for _, group := range cGroups {
+		cGroupNames = append(cGroupNames, group.Name)
+		if group.ID == orgID {
+			everyoneGroup = group.Name
+		}
+	}
+
+	if err := s.syncUserRoles(ctx, user, gGroups); err != nil {
+		log.Printf("failed to sync coder roles for %s: %v", user.Email, err)
+	}
+
+	expected := s.MappingConfig.ExpectedCoderGroups(gGroups)
+	// expected is the set of groups the user should be in
+	// SymmetricDifference returns the groups to add & remove
+	// to make the set {cGroupNames} match the set {expected}
+	add, remove = slice.SymmetricDifference(cGroupNames, append(expected, everyoneGroup))
+	return add, remove, usage, nil
+}
+
+// SyncUsers reconciles the Coder user set with Google Workspace: Workspace
+// users with no corresponding Coder account are created as OIDC users,
+// Workspace users that are suspended or archived are suspended in Coder, and
+// Coder OIDC users in our domain that no longer exist in Workspace are
+// suspended. Users are never deleted, only suspended, so access can be
+// restored if their Workspace account comes back. When s.DryRun is set, no
+// Coder write API is called; the planned mutations are only logged.
+func (s *Sync) SyncUsers(ctx context.Context) error {
+	defaultOrg, err := s.defaultOrganization(ctx)
+	if err != nil {
+		return err
+	}
+
+	googleUsers, _, err := s.GoogleUsers(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list google users: %w", err)
+	}
+
+	coderUsers, err := s.CoderClient.Users(ctx, codersdk.UsersRequest{})
+	if err != nil {
+		return fmt.Errorf("failed to get coder users: %w", err)
+	}
+
+	coderByEmail := make(map[string]codersdk.User, len(coderUsers.Users))
+	for _, user := range coderUsers.Users {
+		coderByEmail[user.Email] = user
+	}
+
+	// Workspace users we've seen, so we can find the Coder OIDC users in our
+	// domain that Workspace no longer knows about.
+	seen := make(map[string]bool, len(googleUsers))
+	for _, gUser := range googleUsers {
+		seen[gUser.PrimaryEmail] = true
+
+		cUser, ok := coderByEmail[gUser.PrimaryEmail]
+		if !ok {
+			if gUser.Suspended || gUser.Archived {
+				// Never been synced before and already offboarded on the
+				// Workspace side: nothing to create, nothing to suspend.
+				continue
+			}
+			if err := s.createCoderUser(ctx, defaultOrg.ID, gUser); err != nil {
+				log.Printf("failed to create coder user %s: %v", gUser.PrimaryEmail, err)
+			}
+			continue
+		}
+
+		if gUser.Suspended || gUser.Archived {
+			if err := s.suspendCoderUser(ctx, cUser); err != nil {
+				log.Printf("failed to suspend coder user %s: %v", gUser.PrimaryEmail, err)
+			}
+		}
+	}
+
+	for email, cUser := range coderByEmail {
+		if seen[email] {
+			continue
+		}
+		if cUser.LoginType != codersdk.LoginTypeOIDC {
+			continue
+		}
+		if !strings.HasSuffix(email, "@"+s.EmailDomain) {
+			continue
+		}
+
+		if err := s.suspendCoderUser(ctx, cUser); err != nil {
+			log.Printf("failed to suspend coder user %s: %v", email, err)
+		}
+	}
+
+	return nil
+}
+
+// syncUserRoles reconciles a user's Coder site roles against the ones
+// mapped from their Google Group membership via MappingConfig.Roles, e.g.
+// "gsuite-admins" -> "owner". Only roles MappingConfig.Roles can grant are
+// touched: any other role on the account (granted by an admin outside
+// gcsync) is left alone. A managed role the user no longer qualifies for
+// (their qualifying group membership is gone) is revoked, which requires
+// calling UpdateUserRoles even when the freshly computed set is empty. It
+// is a no-op when no MappingConfig is set or the mapping has no Roles
+// table.
+func (s *Sync) syncUserRoles(ctx context.Context, user codersdk.User, groups []*admin.Group) error {
+	if s.MappingConfig == nil || len(s.MappingConfig.Roles) == 0 {
+		return nil
+	}
+
+	managed := s.MappingConfig.managedRoles()
+	mapped := s.MappingConfig.rolesFor(groups)
+
+	current := make(map[string]struct{}, len(user.Roles))
+	desired := make(map[string]struct{}, len(user.Roles)+len(mapped))
+	for _, role := range user.Roles {
+		current[role.Name] = struct{}{}
+		if _, ok := managed[role.Name]; ok {
+			continue // re-derived below from current group membership
+		}
+		desired[role.Name] = struct{}{}
+	}
+	for _, role := range mapped {
+		desired[role] = struct{}{}
+	}
+
+	if setsEqual(current, desired) {
+		return nil
+	}
+
+	roles := make([]string, 0, len(desired))
+	for role := range desired {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+
+	if s.DryRun {
+		log.Printf("[dry-run] would set roles %v on %s", roles, user.Email)
+		return nil
+	}
+
+	_, err := s.CoderClient.UpdateUserRoles(ctx, user.ID.String(), codersdk.UpdateRoles{Roles: roles})
+	if err != nil {
+		return fmt.Errorf("update roles for %s: %w", user.Email, err)
+	}
+
+	log.Printf("set roles %v on %s", roles, user.Email)
+	return nil
+}
+
+func setsEqual(a, b map[string]struct{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k := range a {
+		if _, ok := b[k]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// createCoderUser provisions a Coder OIDC account for a Workspace user that
+// has none yet.
+func (s *Sync) createCoderUser(ctx context.Context, orgID uuid.UUID, gUser *admin.User) error {
+	email := gUser.PrimaryEmail
+	if s.DryRun {
+		log.Printf("[dry-run] would create coder user %s", email)
+		return nil
+	}
+
+	username := strings.Split(email, "@")[0]
+	_, err := s.CoderClient.CreateUser(ctx, codersdk.CreateUserRequestWithOrgs{
+		Email:           email,
+		Username:        username,
+		OrganizationIDs: []uuid.UUID{orgID},
+		LoginType:       codersdk.LoginTypeOIDC,
+	})
+	if err != nil {
+		return fmt.Errorf("create user: %w", err)
+	}
+
+	log.Printf("created coder user %s", email)
+	return nil
+}
+
+// suspendCoderUser suspends a Coder user, leaving their account and data
+// intact so access can be restored later. It is a no-op if the user is
+// already suspended.
+func (s *Sync) suspendCoderUser(ctx context.Context, user codersdk.User) error {
+	if user.Status == codersdk.UserStatusSuspended {
+		return nil
+	}
+
+	if s.DryRun {
+		log.Printf("[dry-run] would suspend coder user %s", user.Email)
+		return nil
+	}
+
+	_, err := s.CoderClient.UpdateUserStatus(ctx, user.ID.String(), codersdk.UserStatusSuspended)
+	if err != nil {
+		return fmt.Errorf("suspend user %s: %w", user.Email, err)
+	}
+
+	log.Printf("suspended coder user %s", user.Email)
 	return nil
 }
 
@@ -199,13 +547,27 @@ func (s *Sync) createMissingGroups(ctx context.Context, org uuid.UUID, coderGrou
 	var createdGroups []codersdk.Group
 	for group, _ := range changes {
 		if _, ok := coderGroups[group]; !ok {
-			// Group is missing and must be created.
+			// Group is missing and must be created. Use the mapping's
+			// display name/avatar/quota if one produced this group name,
+			// falling back to the original defaults otherwise.
+			displayName := ""
+			avatarURL := "/emojis/1f195.png" // The "NEW" icon
+			quotaAllowance := 0
+			if mapping, ok := s.MappingConfig.GroupSettings(group); ok {
+				if mapping.DisplayName != "" {
+					displayName = mapping.DisplayName
+				}
+				if mapping.AvatarURL != "" {
+					avatarURL = mapping.AvatarURL
+				}
+				quotaAllowance = mapping.QuotaAllowance
+			}
+
 			newGroup, err := s.CoderClient.CreateGroup(ctx, org, codersdk.CreateGroupRequest{
-				Name:        group,
-				DisplayName: "",
-				// The "NEW" icon
-				AvatarURL:      "/emojis/1f195.png",
-				QuotaAllowance: 0,
+				Name:           group,
+				DisplayName:    displayName,
+				AvatarURL:      avatarURL,
+				QuotaAllowance: quotaAllowance,
 			})
 			if err != nil {
 				delete(changes, group)
@@ -239,6 +601,42 @@ func (s *Sync) userChanges(ctx context.Context, user codersdk.User) (add []strin
 	return nil, nil, nil
 }
 
+// resolveUserGoogleGroups returns the Google Groups a user belongs to,
+// merging in transitive membership against nestedCandidates when
+// s.NestedGroups is set. nestedCache may be shared across users resolved
+// concurrently in the same sync run to avoid re-resolving identical lookups.
+// Each group listing and each IsGroupMember check waits on s.limiter once,
+// and the returned apiUsage counts it as one call (plus its retries). When
+// IsGroupMember falls back from Members.HasMember to Members.Get, that
+// second Admin SDK request is neither paced separately nor counted.
+func (s *Sync) resolveUserGoogleGroups(ctx context.Context, email string, nestedCandidates []*admin.Group, nestedCache *NestedGroupCache) ([]*admin.Group, apiUsage, error) {
+	gGroups, usage, err := s.GoogleGroups(ctx, email)
+	if err != nil {
+		return nil, usage, fmt.Errorf("failed to get google groups for %s: %w", email, err)
+	}
+
+	if !s.NestedGroups {
+		return gGroups, usage, nil
+	}
+
+	checkMembership := func(ctx context.Context, groupKey, member string) (bool, error) {
+		var isMember bool
+		checkUsage, err := s.withGoogleRetry(ctx, func() error {
+			var err error
+			isMember, err = IsGroupMember(ctx, s.GoogleClient, groupKey, member)
+			return err
+		})
+		usage.add(checkUsage)
+		return isMember, err
+	}
+
+	nested, err := NestedGoogleGroups(ctx, email, nestedCandidates, nestedCache, checkMembership)
+	if err != nil {
+		return nil, usage, fmt.Errorf("failed to resolve nested google groups for %s: %w", email, err)
+	}
+	return MergeGroups(gGroups, nested), usage, nil
+}
+
 func (s *Sync) coderGroups(ctx context.Context, orgID uuid.UUID) (map[string]codersdk.Group, error) {
 	coderGroupsResp, err := s.CoderClient.Groups(ctx, codersdk.GroupArguments{
 		Organization: orgID.String(),
@@ -268,23 +666,6 @@ func (s *Sync) defaultOrganization(ctx context.Context) (codersdk.Organization,
 	return codersdk.Organization{}, fmt.Errorf("default organization not found")
 }
 
-// ExpectedCoderGroups returns the list of group names the user is expected
-// to be in based on the Google Groups they are in.
-func ExpectedCoderGroups(groups []*admin.Group) []string {
-	var expected []string
-	for _, group := range groups {
-		if group.Name == "" {
-			log.Printf("Google Group %s has no groupname, skipping", group.Email)
-			continue
-		}
-
-		// normalize names to lowercase and remove spaces
-		normalizedName := strings.ToLower(strings.ReplaceAll(group.Name, " ", ""))
-		expected = append(expected, normalizedName)
-	}
-	return expected
-}
-
 func UserIDsToNames(lookup map[uuid.UUID]codersdk.User, ids []string) []string {
 	var names []string
 	for _, idStr := range ids {
@@ -2,20 +2,13 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"flag"
 	"log"
-	"net/url"
 	"os"
 	"path/filepath"
-	"strings"
+	"time"
 
-	"github.com/google/uuid"
-	"golang.org/x/oauth2/google"
-	admin "google.golang.org/api/admin/directory/v1"
-	"google.golang.org/api/option"
-
-	"github.com/coder/coder/v2/coderd/util/slice"
-	"github.com/coder/coder/v2/codersdk"
+	"github.com/Emyrk/google-workspace-sync/gcsync"
 )
 
 // Requirements:
@@ -23,20 +16,8 @@ import (
 // 2. Service account with domain-wide delegation
 // https://developers.google.com/identity/protocols/oauth2/service-account#delegatingauthority
 // 3. Service Account
-// 4. Rewrite `ExpectedCoderGroups` to your own groups.
-var (
-	// delegatedUserEmail must be an admin of the Google Workspaces
-	delegatedUserEmail      = takeEnvVar("CODER_G_ADMIN_EMAIL", "alice@example.com")
-	googleWorkspaceDomain   = takeEnvVar("CODER_G_SYNC_DOMAIN", "example.com")
-	homeDir, _              = os.UserHomeDir()
-	credentialsJSONFilePath = takeEnvVar("CODER_G_SYNC_CREDS_FILEPATH", filepath.Join(homeDir, "coder", "google-credentials.json"))
-	coderURL                = takeEnvVar("CODER_G_SYNC_CODER_URL", "https://coder.example.com")
-	// coderSessionToken should be from an owner account.
-	coderSessionToken = takeEnvVar("CODER_G_SYNC_SESSION_TOKEN", "APM...w")
-	// googleCustomerID get from https://support.google.com/a/answer/10070793?hl=en
-	googleCustomerID = takeEnvVar("CODER_G_SYNC_CUSTOMER_ID", "G25a24h2h")
-)
-
+// 4. Write a MappingConfig for your own groups, or let ExpectedCoderGroups
+// fall back to passthrough normalization.
 func takeEnvVar(key, fallback string) string {
 	if value, ok := os.LookupEnv(key); ok {
 		return value
@@ -44,6 +25,11 @@ func takeEnvVar(key, fallback string) string {
 	return fallback
 }
 
+func defaultCredentialsPath() string {
+	homeDir, _ := os.UserHomeDir()
+	return filepath.Join(homeDir, "coder", "google-credentials.json")
+}
+
 // Fetches all users currently in Coder.
 // Using their email address, will find all Google Groups they are in.
 // If they are in a Google Group that corresponds to a Coder Group, they will be added to that group.
@@ -51,272 +37,96 @@ func takeEnvVar(key, fallback string) string {
 // Groups are matched by name. Names are mutated to be lowercase and have spaces removed.
 // If the group does not exist in Coder, it will be created.
 func main() {
-	ctx := context.Background()
-	credJSON, err := os.ReadFile(credentialsJSONFilePath)
-	if err != nil {
-		log.Fatalf("failed to read credentials from %q: %v", credentialsJSONFilePath, err)
-	}
-
-	// Auth with Google using delegated credentials
-	cjwt, err := google.JWTConfigFromJSON(credJSON, admin.CloudPlatformScope,
-		admin.AdminDirectoryUserScope,
-		admin.AdminDirectoryUserReadonlyScope,
-		admin.AdminDirectoryGroupScope,
-		admin.AdminDirectoryGroupReadonlyScope)
-	if err != nil {
-		log.Fatalf("failed to create JWT config from JSON (bytes=%d): %v", len(credJSON), err)
-	}
-	// Set to your google workspace admin user.
-	// https://developers.google.com/identity/protocols/oauth2/service-account#delegatingauthority
-	cjwt.Subject = delegatedUserEmail
-
-	// Authenticate with Google
-	adminService, err := admin.NewService(ctx,
-		option.WithHTTPClient(cjwt.Client(ctx)),
+	var (
+		delegatedUserEmail   = flag.String("google-admin-email", takeEnvVar("CODER_G_ADMIN_EMAIL", "alice@example.com"), "Email of a Google Workspace admin to impersonate via domain-wide delegation.")
+		emailDomain          = flag.String("google-domain", takeEnvVar("CODER_G_SYNC_DOMAIN", "example.com"), "Google Workspace domain to sync users/groups for.")
+		credentialsPath      = flag.String("google-creds-path", takeEnvVar("CODER_G_SYNC_CREDS_FILEPATH", defaultCredentialsPath()), "Path to a service account JSON key.")
+		coderURL             = flag.String("coder-url", takeEnvVar("CODER_G_SYNC_CODER_URL", "https://coder.example.com"), "Access URL of the Coder deployment.")
+		coderSessionToken    = flag.String("coder-token", takeEnvVar("CODER_G_SYNC_SESSION_TOKEN", "APM...w"), "Session token of a Coder owner user.")
+		googleCustomerID     = flag.String("google-customer-id", takeEnvVar("CODER_G_SYNC_CUSTOMER_ID", "G25a24h2h"), "Google Workspace customer ID, from https://support.google.com/a/answer/10070793?hl=en.")
+		nestedGroups         = flag.Bool("nested-groups", false, "Resolve transitive (nested) Google Group membership when computing expected Coder groups.")
+		dryRun               = flag.Bool("dry-run", false, "Log planned user mutations instead of making them.")
+		syncUsers            = flag.Bool("sync-users", false, "Also reconcile the Coder user set against Workspace (create/suspend accounts) before syncing groups.")
+		mappingConfigPath    = flag.String("mapping-config", "", "Path to a YAML/JSON group/role mapping config. If unset, Google Group names are normalized directly into Coder group names.")
+		lintMappingConfig    = flag.Bool("lint-mapping-config", false, "Validate -mapping-config against live Google/Coder state and exit, without syncing anything.")
+		daemon               = flag.Bool("daemon", false, "Run continuously: a full sync on startup, then incremental resyncs as Workspace changes are observed, instead of a single sync-and-exit.")
+		watchMode            = flag.String("watch-mode", string(gcsync.WatchModeReportsPoll), "Daemon change-watch backend: reports_poll or pubsub. Only used with -daemon.")
+		pollInterval         = flag.Duration("poll-interval", time.Minute, "How often the reports_poll watch backend polls the Admin SDK Reports API. Only used with -daemon -watch-mode=reports_poll.")
+		checkpointPath       = flag.String("checkpoint-path", "", "File to persist the daemon's last-processed change, so a restart doesn't reprocess it. Only used with -daemon.")
+		pubsubProjectID      = flag.String("pubsub-project-id", "", "GCP project ID of the Pub/Sub subscription. Only used with -daemon -watch-mode=pubsub.")
+		pubsubSubscriptionID = flag.String("pubsub-subscription-id", "", "Pub/Sub subscription ID fed by the Workspace Events API. Only used with -daemon -watch-mode=pubsub.")
+		concurrency          = flag.Int("concurrency", 0, "Number of users SyncGroups resolves and patches concurrently. 0 uses the built-in default.")
+		googleQPS            = flag.Float64("google-qps", 0, "Admin SDK requests per second to allow. 0 uses the built-in default.")
+		credentialSource     = flag.String("credential-source", string(gcsync.CredentialSourceServiceAccountJSON), "How to obtain Google credentials: service_account_json, application_default, or impersonate.")
+		impersonateAccount   = flag.String("impersonate-service-account", "", "Service account to impersonate via ADC when -credential-source=impersonate. Must have domain-wide delegation enabled.")
 	)
-	if err != nil {
-		panic(err)
-	}
-
-	// Authenticate with Coder
-	u, _ := url.Parse(coderURL)
-	client := codersdk.New(u)
-	client.SetSessionToken(coderSessionToken)
+	flag.Parse()
 
-	coderOrganizations, err := client.Organizations(ctx)
-	if err != nil {
-		log.Fatalf("failed to get coder organizations: %v", err)
-	}
-
-	// Only syncing groups into the default organization
-	var defaultOrg codersdk.Organization
-	for _, org := range coderOrganizations {
-		if org.IsDefault {
-			defaultOrg = org
-			break
+	ctx := context.Background()
+	cfg := &gcsync.Config{
+		CoderURL:                   *coderURL,
+		CoderSessionToken:          *coderSessionToken,
+		GoogleCustomerID:           *googleCustomerID,
+		CredentialSource:           gcsync.CredentialSource(*credentialSource),
+		GCPCredentialsJSONFilePath: *credentialsPath,
+		ImpersonateServiceAccount:  *impersonateAccount,
+		DelegatedUserEmail:         *delegatedUserEmail,
+		EmailDomain:                *emailDomain,
+		NestedGroups:               *nestedGroups,
+		DryRun:                     *dryRun,
+		WatchMode:                  gcsync.WatchMode(*watchMode),
+		PollInterval:               *pollInterval,
+		CheckpointPath:             *checkpointPath,
+		PubSubProjectID:            *pubsubProjectID,
+		PubSubSubscriptionID:       *pubsubSubscriptionID,
+		Concurrency:                *concurrency,
+		GoogleQPS:                  *googleQPS,
+	}
+
+	if *mappingConfigPath != "" {
+		mapping, err := gcsync.LoadMappingConfig(*mappingConfigPath)
+		if err != nil {
+			log.Fatalf("failed to load mapping config %q: %v", *mappingConfigPath, err)
 		}
+		cfg.MappingConfig = mapping
 	}
 
-	userByID := make(map[uuid.UUID]codersdk.User) // Used for logging/debugging
-	coderGroups := make(map[string]codersdk.Group)
-	coderGroupChanges := make(ChangeGroupRequests)
-	coderGroupsResp, err := client.Groups(ctx, codersdk.GroupArguments{
-		Organization: defaultOrg.ID.String(),
-	})
+	sync, err := gcsync.New(ctx, cfg)
 	if err != nil {
-		log.Fatalf("failed to get coder groups: %v", err)
+		log.Fatalf("failed to initialize gcsync: %v", err)
 	}
 
-	for _, group := range coderGroupsResp {
-		coderGroups[group.Name] = group
-	}
-
-	// Find all users on Coder
-	coderUsers, err := client.Users(ctx, codersdk.UsersRequest{})
-	if err != nil {
-		log.Fatalf("failed to get coder users: %w", err)
-	}
-
-	oidcUserCount := 0
-	for _, user := range coderUsers.Users {
-		userByID[user.ID] = user
-		if user.LoginType != codersdk.LoginTypeOIDC {
-			continue // Not a Google Workspace user
-		}
-
-		// Only for the Google Workspace domain
-		if !strings.HasSuffix(user.Email, "@"+googleWorkspaceDomain) {
-			continue
-		}
-		oidcUserCount++
-
-		gGroups, err := GoogleGroups(ctx, adminService, user.Email)
-		if err != nil {
-			log.Fatalf("failed to get Google Groups for %s: %v", user.Email, err)
+	if *lintMappingConfig {
+		if cfg.MappingConfig == nil {
+			log.Fatalf("-lint-mapping-config requires -mapping-config")
 		}
-
-		cGroups, err := client.Groups(ctx, codersdk.GroupArguments{
-			HasMember: user.Username,
-		})
-		if err != nil {
-			log.Fatalf("failed to get coder groups for user %s: %v", user.Email, err)
-		}
-
-		var everyoneGroup = "Everyone"
-		var cGroupNames []string
-		for _, group := range cGroups {
-			cGroupNames = append(cGroupNames, group.Name)
-			if group.ID == defaultOrg.ID {
-				everyoneGroup = group.Name
-			}
-		}
-
-		expected := ExpectedCoderGroups(gGroups)
-		// expected is the set of groups the user should be in
-		// SymmetricDifference returns the groups to add & remove
-		// to make the set {cGroupNames} match the set {expected}
-		add, remove := slice.SymmetricDifference(cGroupNames, append(expected, everyoneGroup))
-		for _, group := range add {
-			coderGroupChanges.AddUser(group, user.ID.String())
+		problems := sync.LintConfig(ctx, cfg.MappingConfig)
+		if len(problems) == 0 {
+			log.Printf("mapping config %q is valid", *mappingConfigPath)
+			return
 		}
-		for _, group := range remove {
-			coderGroupChanges.RemoveUser(group, user.ID.String())
+		for _, problem := range problems {
+			log.Printf("problem: %v", problem)
 		}
+		os.Exit(1)
 	}
 
-	var createdGroups []codersdk.Group
-	// Create missing groups
-	for group, _ := range coderGroupChanges {
-		if _, ok := coderGroups[group]; !ok {
-			newGroup, err := client.CreateGroup(ctx, defaultOrg.ID, codersdk.CreateGroupRequest{
-				Name:        group,
-				DisplayName: "",
-				// The "NEW" icon
-				AvatarURL:      "/emojis/1f195.png",
-				QuotaAllowance: 0,
-			})
-			if err != nil {
-				delete(coderGroupChanges, group)
-				log.Printf("failed to create group %q, users in this group will not be assigned: %v", group, err)
-				continue
-			}
-			createdGroups = append(createdGroups, newGroup)
-			coderGroups[group] = newGroup
+	if *daemon {
+		if err := sync.Run(ctx); err != nil {
+			log.Fatalf("daemon exited: %v", err)
 		}
-	}
-
-	if len(coderGroupChanges) == 0 {
-		log.Printf("No changes to make, all %d OIDC users in your Google domain are in the correct groups", oidcUserCount)
 		return
 	}
 
-	log.Println("Changes made:")
-	if len(createdGroups) > 0 {
-		log.Printf("Created %d groups", len(createdGroups))
-		for _, group := range createdGroups {
-			log.Printf("\t%s :: %s", group.Name, group.ID)
-		}
-	}
-
-	if len(coderGroupChanges) > 0 {
-		log.Printf("Changes to group memberships:")
-	}
-
-	// Add/Remove all the users
-	for group, req := range coderGroupChanges {
-		coderGroup, ok := coderGroups[group]
-		if !ok {
-			log.Fatalf("group %s not found, does it exist in Coder?", group)
-		}
-
-		_, err = client.PatchGroup(ctx, coderGroup.ID, req)
-		if err != nil {
-			log.Fatalf("failed to patch group %s: %v", group, err)
-		}
-
-		log.Printf("\tGroup %s: %d added, %d removed", group, len(req.AddUsers), len(req.RemoveUsers))
-		log.Printf("\t\tAdded: %v", UserIDsToNames(userByID, req.AddUsers))
-		log.Printf("\t\tRemoved: %v", UserIDsToNames(userByID, req.RemoveUsers))
-	}
-}
-
-// ExpectedCoderGroups returns the list of group names the user is expected
-// to be in based on the Google Groups they are in.
-func ExpectedCoderGroups(groups []*admin.Group) []string {
-	var expected []string
-	for _, group := range groups {
-		if group.Name == "" {
-			log.Printf("Google Group %s has no groupname, skipping", group.Email)
-			continue
-		}
-
-		// normalize names to lowercase and remove spaces
-		normalizedName := strings.ToLower(strings.ReplaceAll(group.Name, " ", ""))
-		expected = append(expected, normalizedName)
-	}
-	return expected
-}
-
-func GoogleGroups(ctx context.Context, srv *admin.Service, email string) ([]*admin.Group, error) {
-	var allGroups []*admin.Group
-	var pageToken string
-
-	// Call api until all groups are read. Loop for pagination
-	for {
-		googleGroups, err := srv.Groups.List().
-			Context(ctx).
-			PageToken(pageToken).
-			UserKey(email).
-			Do()
-		if err != nil {
-			return nil, fmt.Errorf("failed to list groups: %w", err)
-		}
-
-		allGroups = append(allGroups, googleGroups.Groups...)
-		if googleGroups.NextPageToken == "" {
-			break
-		}
-		pageToken = googleGroups.NextPageToken
-	}
-
-	return allGroups, nil
-}
-
-func GoogleUsers(ctx context.Context, srv *admin.Service) ([]*admin.User, error) {
-	var allUsers []*admin.User
-	var pageToken string
-
-	// Call api until all users are read. Loop for pagination
-	for {
-		googleUsers, err := srv.Users.List().
-			// Customer ID: https://support.google.com/a/answer/10070793?hl=en
-			Customer(googleCustomerID).
-			Context(ctx).
-			PageToken(pageToken).
-			Do()
-		if err != nil {
-			return nil, fmt.Errorf("failed to list users: %w", err)
-		}
-
-		allUsers = append(allUsers, googleUsers.Users...)
-		if googleUsers.NextPageToken == "" {
-			break
-		}
-		pageToken = googleUsers.NextPageToken
-	}
-
-	return allUsers, nil
-}
-
-func UserIDsToNames(lookup map[uuid.UUID]codersdk.User, ids []string) []string {
-	var names []string
-	for _, idStr := range ids {
-		id, err := uuid.Parse(idStr)
-		if user, ok := lookup[id]; err == nil && ok {
-			names = append(names, user.Email)
-			continue
+	if *syncUsers {
+		if err := sync.SyncUsers(ctx); err != nil {
+			log.Fatalf("failed to sync users: %v", err)
 		}
-		names = append(names, id.String())
-	}
-	return names
-}
-
-type ChangeGroupRequests map[string]codersdk.PatchGroupRequest
-
-func (c ChangeGroupRequests) AddUser(group, user string) {
-	if _, ok := c[group]; !ok {
-		c[group] = codersdk.PatchGroupRequest{}
 	}
-	req := c[group]
-	req.AddUsers = append(req.AddUsers, user)
-	c[group] = req
-}
 
-func (c ChangeGroupRequests) RemoveUser(group, user string) {
-	if _, ok := c[group]; !ok {
-		c[group] = codersdk.PatchGroupRequest{}
+	stats, err := sync.SyncGroups(ctx)
+	if err != nil {
+		log.Fatalf("failed to sync groups: %v", err)
 	}
-	req := c[group]
-	req.RemoveUsers = append(req.RemoveUsers, user)
-	c[group] = req
+	log.Printf("sync complete: %s", stats)
 }